@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/ini.v1"
+)
+
+// mqttConfig holds the resolved MQTT connection settings: an optional
+// [mqtt] section in the device settings file, falling back to the
+// corresponding -mqtt-* flags. This lets a deployment ship one config file,
+// merged with the devices.ini it already needs, instead of a long flag line.
+type mqttConfig struct {
+	host     string
+	port     int
+	clientID string
+	username string
+	password string
+
+	keepAlive time.Duration
+
+	tlsEnabled bool
+	caFile     string
+	certFile   string
+	keyFile    string
+	insecure   bool
+
+	statusTopic string
+}
+
+func loadMqttConfig(iniFile *ini.File) mqttConfig {
+	sec := iniFile.Section("mqtt")
+	return mqttConfig{
+		host:     sec.Key("host").MustString(*mqttHost),
+		port:     sec.Key("port").MustInt(*mqttPort),
+		clientID: sec.Key("client-id").MustString(*mqttClientId),
+		username: sec.Key("user").MustString(*mqttUser),
+		password: sec.Key("password").MustString(*mqttPassword),
+
+		keepAlive: sec.Key("keepalive").MustDuration(*mqttKeepAlive),
+
+		tlsEnabled: sec.Key("tls").MustBool(*mqttTLS),
+		caFile:     sec.Key("ca").MustString(*mqttCA),
+		certFile:   sec.Key("cert").MustString(*mqttCert),
+		keyFile:    sec.Key("key").MustString(*mqttKey),
+		insecure:   sec.Key("insecure").MustBool(*mqttInsecure),
+
+		statusTopic: sec.Key("status-topic").MustString(*mqttStatusTopic),
+	}
+}
+
+// buildTLSConfig loads the CA/client certificate material configured for the
+// MQTT connection. A blank caFile leaves the system trust store in place.
+func (c mqttConfig) buildTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.insecure}
+
+	if c.caFile != "" {
+		caPEM, err := os.ReadFile(c.caFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read mqtt CA file")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, errors.Errorf("no certificates found in %s", c.caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if c.certFile != "" || c.keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "load mqtt client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// applyScanOverrides lets an optional [scan] section in the device settings
+// file override the scan/publish flags, same precedence rule as mqttConfig:
+// the config file wins when a key is present, the flag default otherwise.
+func applyScanOverrides(iniFile *ini.File) {
+	sec := iniFile.Section("scan")
+	*scanDuration = sec.Key("sd").MustDuration(*scanDuration)
+	*interval = sec.Key("interval").MustDuration(*interval)
+	*passive = sec.Key("passive").MustBool(*passive)
+	*device = sec.Key("device").MustString(*device)
+	*publishFormat = sec.Key("publish-format").MustString(*publishFormat)
+	*graphitePrefix = sec.Key("graphite-prefix").MustString(*graphitePrefix)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// deviceHealth tracks how a single sensor has behaved across cycles, so
+// operators can alert on devices that are failing or have gone stale
+// without needing to parse the relay's logs.
+type deviceHealth struct {
+	SensorName          string `json:"sensorname"`
+	Address             string `json:"address"`
+	SuccessCount        int    `json:"success_count"`
+	FailureCount        int    `json:"failure_count"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	LastSeen            int64  `json:"last_seen"`
+	LastRSSI            int    `json:"last_rssi"`
+}
+
+// healthTracker accumulates deviceHealth across daemon iterations. It is
+// created once in main and shared across cycles, so counts and
+// consecutive-failure streaks persist for the life of the process.
+type healthTracker struct {
+	devices map[string]*deviceHealth
+}
+
+func newHealthTracker() *healthTracker {
+	return &healthTracker{devices: make(map[string]*deviceHealth)}
+}
+
+func (h *healthTracker) device(address string) *deviceHealth {
+	d, ok := h.devices[address]
+	if !ok {
+		d = &deviceHealth{Address: address}
+		h.devices[address] = d
+	}
+	return d
+}
+
+// recordSeen marks a device as seen in the current cycle's scan, along with
+// the RSSI its advertisement carried.
+func (h *healthTracker) recordSeen(address, sensorName string, rssi int) {
+	d := h.device(address)
+	d.SensorName = sensorName
+	d.LastRSSI = rssi
+	d.LastSeen = time.Now().Unix()
+}
+
+// recordResult tallies a read/publish attempt's outcome for a device.
+func (h *healthTracker) recordResult(address, sensorName string, err error) {
+	d := h.device(address)
+	d.SensorName = sensorName
+	if err == nil {
+		d.SuccessCount++
+		d.ConsecutiveFailures = 0
+	} else {
+		d.FailureCount++
+		d.ConsecutiveFailures++
+	}
+}
+
+// publish sends every tracked device's health as its own retained JSON
+// message to <topic>/health, once per cycle, regardless of whether the
+// device was seen this time around.
+func (h *healthTracker) publish(client mqtt.Client, knownSensors map[string]sensorInfo) {
+	for address, d := range h.devices {
+		info, ok := knownSensors[address]
+		if !ok {
+			continue
+		}
+
+		healthPayload, err := json.Marshal(d)
+		if err != nil {
+			fmt.Printf("Error marshaling health for %s: %s\n", address, err)
+			continue
+		}
+
+		topic := info.mqttTopic + "/health"
+		token := client.Publish(topic, 0, true, healthPayload)
+		token.Wait()
+		if err := token.Error(); err != nil {
+			fmt.Printf("Error publishing health for %s: %s\n", address, err)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	temperatureGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "atc_temperature_celsius",
+		Help: "Last reported temperature, in degrees Celsius.",
+	}, []string{"sensorname", "address", "topic"})
+
+	humidityGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "atc_humidity_percent",
+		Help: "Last reported relative humidity, in percent.",
+	}, []string{"sensorname", "address", "topic"})
+
+	batteryGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "atc_battery_percent",
+		Help: "Last reported battery level, in percent.",
+	}, []string{"sensorname", "address", "topic"})
+
+	rssiGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "atc_rssi_dbm",
+		Help: "RSSI of the device's last seen advertisement, in dBm.",
+	}, []string{"sensorname", "address", "topic"})
+
+	lastReadGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "atc_last_read_timestamp_seconds",
+		Help: "Unix timestamp of the last successful reading for a device.",
+	}, []string{"sensorname", "address", "topic"})
+
+	scanTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "atc_scan_total",
+		Help: "Number of scan/publish cycles the relay has run.",
+	})
+
+	readFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "atc_read_failures_total",
+		Help: "Number of device reads that failed after all retries.",
+	})
+
+	publishFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "atc_publish_failures_total",
+		Help: "Number of MQTT publishes of a reading that failed, including an unresolvable per-device publish format.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		temperatureGauge,
+		humidityGauge,
+		batteryGauge,
+		rssiGauge,
+		lastReadGauge,
+		scanTotal,
+		readFailuresTotal,
+		publishFailuresTotal,
+	)
+}
+
+// maybeStartPromServer starts the Prometheus /metrics endpoint on
+// -prom-listen, if set, and returns the server so it can be shut down
+// alongside the rest of the relay. Returns nil when -prom-listen is empty.
+func maybeStartPromServer(listenAddr string) *http.Server {
+	if listenAddr == "" {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{Addr: listenAddr, Handler: mux}
+
+	go func() {
+		fmt.Printf("[prometheus] serving /metrics on %s\n", listenAddr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fmt.Printf("[prometheus] server error: %s\n", err)
+		}
+	}()
+
+	return server
+}
+
+// recordReading updates the gauges for a device from its latest reading.
+// Readings come from the same in-memory scan results already being
+// published over MQTT, so scraping /metrics never triggers an extra BLE read.
+func recordReading(info sensorInfo, address string, rssi int, payload map[string]interface{}) {
+	labels := prometheus.Labels{
+		"sensorname": info.sensorName,
+		"address":    address,
+		"topic":      info.mqttTopic,
+	}
+
+	if v, ok := numericValue(payload["temperature"]); ok {
+		temperatureGauge.With(labels).Set(v)
+	}
+	if v, ok := numericValue(payload["humidity"]); ok {
+		humidityGauge.With(labels).Set(v)
+	}
+	if v, ok := numericValue(payload["battery"]); ok {
+		batteryGauge.With(labels).Set(v)
+	}
+
+	rssiGauge.With(labels).Set(float64(rssi))
+	lastReadGauge.With(labels).Set(float64(payloadTimestamp(payload)))
+}
+
+// numericValue converts one of the numeric types the payload map can hold
+// (float32, uint8, uint16, int64, ...) into a float64 Prometheus can set.
+func numericValue(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	default:
+		return 0, false
+	}
+}
+
+func payloadTimestamp(payload map[string]interface{}) int64 {
+	ts, _ := numericValue(payload["timestamp"])
+	return int64(ts)
+}
+
+func shutdownPromServer(server *http.Server) {
+	if server == nil {
+		return
+	}
+	_ = server.Shutdown(context.Background())
+}
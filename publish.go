@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+)
+
+// metricKeys lists the payload fields that are rendered as individual
+// measurements by the line-oriented publish formats (graphite, influx).
+var metricKeys = []string{"temperature", "humidity", "battery"}
+
+// Publisher turns a single sensor reading into one or more MQTT publishes.
+// Implementations are looked up by name through publisherRegistry so the
+// format can be chosen globally with -publish-format or overridden per
+// device in devices.ini.
+type Publisher interface {
+	Publish(client mqtt.Client, topic string, info sensorInfo, payload map[string]interface{}) error
+}
+
+// publisherRegistry resolves the Publisher to use for a given sensor,
+// falling back to the global default when the device has no format override.
+type publisherRegistry struct {
+	defaultFormat string
+	publishers    map[string]Publisher
+}
+
+func newPublisherRegistry(defaultFormat, graphitePrefix string) *publisherRegistry {
+	return &publisherRegistry{
+		defaultFormat: defaultFormat,
+		publishers: map[string]Publisher{
+			"json":          jsonPublisher{},
+			"graphite":      graphitePublisher{prefix: graphitePrefix},
+			"influx":        influxPublisher{},
+			"homeassistant": newHomeAssistantPublisher(),
+		},
+	}
+}
+
+func (r *publisherRegistry) For(info sensorInfo) (Publisher, error) {
+	format := info.format
+	if format == "" {
+		format = r.defaultFormat
+	}
+
+	p, ok := r.publishers[format]
+	if !ok {
+		return nil, errors.Errorf("unknown publish format %q for sensor %q", format, info.sensorName)
+	}
+	return p, nil
+}
+
+// publishMqtt sends a single payload to topic and waits for the publish to
+// complete.
+func publishMqtt(client mqtt.Client, topic string, payload []byte) error {
+	fmt.Printf("[MQTT] Sending payload to %s: %s\n", topic, payload)
+	token := client.Publish(topic, 0, false, payload)
+	token.Wait()
+	return token.Error()
+}
+
+// jsonPublisher publishes the reading as-is, JSON-encoded. This is the
+// original, and still default, publish format.
+type jsonPublisher struct{}
+
+func (jsonPublisher) Publish(client mqtt.Client, topic string, info sensorInfo, payload map[string]interface{}) error {
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		return errors.Wrap(err, "marshal json payload")
+	}
+	return publishMqtt(client, topic, jsonPayload)
+}
+
+// graphitePublisher renders each metric as a Graphite plaintext line,
+// <prefix>.<sensorname>.<metric> <value> <timestamp>, one per line.
+type graphitePublisher struct {
+	prefix string
+}
+
+func (p graphitePublisher) Publish(client mqtt.Client, topic string, info sensorInfo, payload map[string]interface{}) error {
+	ts, _ := payload["timestamp"].(int64)
+	name := slugify(info.sensorName)
+
+	var lines []string
+	for _, metric := range metricKeys {
+		if v, ok := payload[metric]; ok {
+			lines = append(lines, fmt.Sprintf("%s.%s.%s %v %d", p.prefix, name, metric, v, ts))
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+
+	return publishMqtt(client, topic, []byte(strings.Join(lines, "\n")))
+}
+
+// influxPublisher renders the reading as a single InfluxDB line protocol
+// point, tagged by sensor name and address.
+type influxPublisher struct{}
+
+func (influxPublisher) Publish(client mqtt.Client, topic string, info sensorInfo, payload map[string]interface{}) error {
+	ts, _ := payload["timestamp"].(int64)
+	address, _ := payload["address"].(string)
+
+	var fields []string
+	for _, metric := range metricKeys {
+		if v, ok := payload[metric]; ok {
+			fields = append(fields, fmt.Sprintf("%s=%v", metric, v))
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	line := fmt.Sprintf("sensor,name=%s,address=%s %s %d",
+		influxEscape(info.sensorName), address, strings.Join(fields, ","), ts*1e9)
+
+	return publishMqtt(client, topic, []byte(line))
+}
+
+// homeAssistantPublisher publishes readings as JSON, like jsonPublisher, but
+// additionally emits retained MQTT discovery configs the first time each
+// sensor is seen, so ATC sensors auto-register in Home Assistant.
+type homeAssistantPublisher struct {
+	announced map[string]bool
+	json      jsonPublisher
+}
+
+func newHomeAssistantPublisher() *homeAssistantPublisher {
+	return &homeAssistantPublisher{announced: make(map[string]bool)}
+}
+
+type haMetric struct {
+	key               string
+	deviceClass       string
+	unitOfMeasurement string
+}
+
+var haMetrics = []haMetric{
+	{"temperature", "temperature", "°C"},
+	{"humidity", "humidity", "%"},
+	{"battery", "battery", "%"},
+}
+
+func (p *homeAssistantPublisher) Publish(client mqtt.Client, topic string, info sensorInfo, payload map[string]interface{}) error {
+	address, _ := payload["address"].(string)
+	if address != "" && !p.announced[address] {
+		if err := p.announce(client, topic, info, address); err != nil {
+			return err
+		}
+		p.announced[address] = true
+	}
+
+	return p.json.Publish(client, topic, info, payload)
+}
+
+// announce publishes one retained discovery config per metric to
+// homeassistant/sensor/<slug>_<metric>/config, sharing a single device block
+// keyed by the sensor's MAC address.
+func (p *homeAssistantPublisher) announce(client mqtt.Client, stateTopic string, info sensorInfo, address string) error {
+	slug := slugify(info.sensorName)
+	device := map[string]interface{}{
+		"identifiers":  []string{address},
+		"name":         info.sensorName,
+		"manufacturer": "Xiaomi",
+		"model":        "ATC_MiThermometer",
+	}
+
+	for _, m := range haMetrics {
+		config := map[string]interface{}{
+			"name":                fmt.Sprintf("%s %s", info.sensorName, m.key),
+			"unique_id":           fmt.Sprintf("%s_%s", slug, m.key),
+			"state_topic":         stateTopic,
+			"value_template":      fmt.Sprintf("{{ value_json.%s }}", m.key),
+			"device_class":        m.deviceClass,
+			"unit_of_measurement": m.unitOfMeasurement,
+			"device":              device,
+		}
+
+		configPayload, err := json.Marshal(config)
+		if err != nil {
+			return errors.Wrapf(err, "marshal HA discovery config for %s", m.key)
+		}
+
+		configTopic := fmt.Sprintf("homeassistant/sensor/%s_%s/config", slug, m.key)
+		fmt.Printf("[MQTT] Sending HA discovery config to %s: %s\n", configTopic, configPayload)
+		token := client.Publish(configTopic, 0, true, configPayload)
+		token.Wait()
+		if err := token.Error(); err != nil {
+			return errors.Wrapf(err, "publish HA discovery config for %s", m.key)
+		}
+	}
+
+	return nil
+}
+
+var slugDisallowedChars = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// slugify renders a sensor name safe for use as a Graphite metric path
+// segment or a Home Assistant object_id.
+func slugify(name string) string {
+	return slugDisallowedChars.ReplaceAllString(strings.ToLower(name), "_")
+}
+
+var influxEscapeReplacer = strings.NewReplacer(" ", `\ `, ",", `\,`, "=", `\=`)
+
+// influxEscape escapes the characters InfluxDB line protocol treats
+// specially in tag values.
+func influxEscape(s string) string {
+	return influxEscapeReplacer.Replace(s)
+}
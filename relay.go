@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"encoding/binary"
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
 	"regexp"
 	"strings"
+	"syscall"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -34,12 +37,32 @@ var (
 	device = flag.String("device", "default", "implementation of ble")
 
 	scanDuration = flag.Duration("sd", 5*time.Second, "scanning duration, 0 for indefinitely")
+	interval     = flag.Duration("interval", 60*time.Second, "how often to scan, connect and publish; the relay keeps running and repeats the cycle on this interval")
+	passive      = flag.Bool("passive", false, "decode readings straight from ATC1441/pvvx advertisement service data instead of connecting via GATT")
 
 	deviceSettingsFile = flag.String("device-settings", "devices.ini", "device settings file")
 
-	mqttHost     = flag.String("mqtt-host", "localhost", "MQTT host")
-	mqttPort     = flag.Int("mqtt-port", 1883, "MQTT port")
-	mqttClientId = flag.String("mqtt-client-id", "atc-sensor-relay", "MQTT client ID")
+	mqttHost      = flag.String("mqtt-host", "localhost", "MQTT host")
+	mqttPort      = flag.Int("mqtt-port", 1883, "MQTT port")
+	mqttClientId  = flag.String("mqtt-client-id", "atc-sensor-relay", "MQTT client ID")
+	mqttKeepAlive = flag.Duration("mqtt-keepalive", 30*time.Second, "MQTT keep-alive interval")
+	mqttUser      = flag.String("mqtt-user", "", "MQTT username, if the broker requires authentication")
+	mqttPassword  = flag.String("mqtt-password", "", "MQTT password, if the broker requires authentication")
+
+	mqttTLS      = flag.Bool("mqtt-tls", false, "connect to the broker over TLS")
+	mqttCA       = flag.String("mqtt-ca", "", "PEM file of the CA to trust for the broker's certificate, in addition to the system trust store")
+	mqttCert     = flag.String("mqtt-cert", "", "PEM client certificate for TLS client authentication")
+	mqttKey      = flag.String("mqtt-key", "", "PEM private key matching -mqtt-cert")
+	mqttInsecure = flag.Bool("mqtt-insecure", false, "skip TLS certificate verification")
+
+	mqttStatusTopic = flag.String("mqtt-status-topic", "atc-sensor-relay/status", "topic for the retained online/offline Last Will & Testament")
+
+	publishFormat  = flag.String("publish-format", "json", "default payload format: json, graphite, influx, or homeassistant (overridable per device in devices.ini)")
+	graphitePrefix = flag.String("graphite-prefix", "sensors", "metric path prefix used by the graphite publish format")
+
+	readRetries = flag.Int("read-retries", 2, "number of retries, with exponential backoff, after a failed GATT read before giving up on a device for this cycle")
+
+	promListen = flag.String("prom-listen", "", "address to serve Prometheus metrics on (e.g. :9110); disabled when empty")
 )
 
 func isAtcDevice(a ble.Advertisement) bool {
@@ -52,25 +75,32 @@ func isAtcDevice(a ble.Advertisement) bool {
 type sensorInfo struct {
 	sensorName string
 	mqttTopic  string
+	format     string // publish format override; empty means use -publish-format
 }
 
-func loadKnownSensors(settingsFilePath string) map[string]sensorInfo {
+// loadKnownSensors reads the per-device sections out of the settings file.
+// The same file also carries the relay's own [mqtt] and [scan] sections
+// (see loadMqttConfig and applyScanOverrides), so it is loaded once in main
+// and shared rather than re-read here.
+func loadKnownSensors(iniFile *ini.File) map[string]sensorInfo {
 	// parse an ini file like this
 	/*
 		$ cat ./devices.ini
+		[mqtt]
+		host=localhost
+		user=relay
+
+		[scan]
+		interval=60s
+
 		[A4:C1:38:0C:5B:45]
 		sensorname=edge of desk
 		topic=temperature/room
+		format=influx
 
 		[...next device...]
 	*/
 
-	// read the ini file
-	iniFile, err := ini.Load(settingsFilePath)
-	if err != nil {
-		log.Fatalf("can't load device settings file: %s", err)
-	}
-
 	knownSensors := make(map[string]sensorInfo)
 
 	addressMatcher := regexp.MustCompile(macAddressRegex)
@@ -97,10 +127,17 @@ func loadKnownSensors(settingsFilePath string) map[string]sensorInfo {
 			log.Fatalf("can't get MQTT topic: %s", err)
 		}
 
+		// a per-device publish format is optional; falls back to -publish-format
+		format := ""
+		if formatKey, err := section.GetKey("format"); err == nil {
+			format = strings.ToLower(formatKey.String())
+		}
+
 		// add the sensor to the known sensors map
 		knownSensors[strings.ToLower(addressOrName)] = sensorInfo{
 			sensorName: strings.ToLower(sensorName.String()),
 			mqttTopic:  mqttTopic.String(),
+			format:     format,
 		}
 	}
 
@@ -108,9 +145,20 @@ func loadKnownSensors(settingsFilePath string) map[string]sensorInfo {
 }
 
 func main() {
+	flag.Parse()
+
+	// the device settings file doubles as the relay's config file: besides
+	// the per-device sections it may carry [mqtt] and [scan] sections that
+	// override the corresponding flags, so a deployment ships one file.
+	iniFile, err := ini.Load(*deviceSettingsFile)
+	if err != nil {
+		log.Fatalf("can't load device settings file: %s", err)
+	}
+	applyScanOverrides(iniFile)
+	mqttCfg := loadMqttConfig(iniFile)
 
 	// read known sensor mapping
-	knownSensors := loadKnownSensors(*deviceSettingsFile)
+	knownSensors := loadKnownSensors(iniFile)
 	fmt.Printf("Known sensors: %v\n", knownSensors)
 
 	if len(knownSensors) == 0 {
@@ -118,26 +166,85 @@ func main() {
 		return
 	}
 
-	flag.Parse()
-
 	d, err := dev.NewDevice(*device)
 	if err != nil {
 		log.Fatalf("can't new device : %s", err)
 	}
 	ble.SetDefaultDevice(d)
 
-	foundDevices := make(map[string]sensorInfo)
+	client, err := newMqttClient(mqttCfg)
+	if err != nil {
+		log.Fatalf("can't build MQTT client: %s", err)
+	}
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		log.Fatalf("[MQTT] can't connect: %s", token.Error())
+	}
+	defer func() {
+		// publish offline ourselves on a clean shutdown; the LWT only fires
+		// when the broker notices the connection drop without one.
+		token := client.Publish(mqttCfg.statusTopic, 0, true, "offline")
+		token.Wait()
+		client.Disconnect(1000)
+	}()
+
+	registry := newPublisherRegistry(*publishFormat, *graphitePrefix)
+	health := newHealthTracker()
 
-	// Print the results map
-	for key, value := range foundDevices {
-		fmt.Printf("ID: %s, %s\n", key, value)
+	promServer := maybeStartPromServer(*promListen)
+	defer shutdownPromServer(promServer)
+
+	// ctx is cancelled on SIGINT/SIGTERM so the daemon can shut down gracefully
+	// between iterations instead of being killed mid-cycle.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fmt.Printf("starting relay loop, polling every %s\n", *interval)
+	runCycle(ctx, knownSensors, client, registry, health)
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			fmt.Println("shutting down...")
+			return
+		case <-ticker.C:
+			runCycle(ctx, knownSensors, client, registry, health)
+		}
 	}
+}
+
+// runCycle performs a single scan -> connect -> publish pass. It is given its
+// own timeout, derived from parentCtx, so a peripheral that hangs mid-read
+// can't block the next tick from running. Health metrics for every known
+// sensor are published afterwards regardless of whether it was seen this
+// cycle, so operators can alert on sensors that have gone stale.
+func runCycle(parentCtx context.Context, knownSensors map[string]sensorInfo, client mqtt.Client, registry *publisherRegistry, health *healthTracker) {
+	cycleCtx, cancel := context.WithTimeout(parentCtx, *interval)
+	defer cancel()
+
+	if *passive {
+		runPassiveCycle(cycleCtx, knownSensors, client, registry, health)
+	} else {
+		runActiveCycle(cycleCtx, knownSensors, client, registry, health)
+	}
+
+	health.publish(client, knownSensors)
+}
+
+// runActiveCycle is the GATT connect-per-device path: scan for known
+// devices, then connect to each in turn to read its characteristics.
+func runActiveCycle(cycleCtx context.Context, knownSensors map[string]sensorInfo, client mqtt.Client, registry *publisherRegistry, health *healthTracker) {
+	scanTotal.Inc()
 
-	scanContext := ble.WithSigHandler(context.WithTimeout(context.Background(), *scanDuration))
+	foundDevices := make(map[string]sensorInfo)
+	rssi := make(map[string]int)
+
+	scanContext := ble.WithSigHandler(context.WithTimeout(cycleCtx, *scanDuration))
 
 	// Scan for specified durantion, or until interrupted by user.
 	fmt.Printf("Scanning for %s...\n", *scanDuration)
-	// Scan for specified durantion, or until interrupted by user.
 	chkErr(ble.Scan(scanContext, false, func(a ble.Advertisement) {
 		deviceAddress := strings.ToLower(a.Addr().String())
 		deviceLocalName := a.LocalName()
@@ -145,95 +252,265 @@ func main() {
 		// check if either the address or local name is in the known devices
 		if info, ok := knownSensors[deviceAddress]; ok {
 			foundDevices[deviceAddress] = info
+			rssi[deviceAddress] = a.RSSI()
 		} else if info, ok := knownSensors[deviceLocalName]; ok {
 			foundDevices[deviceLocalName] = info
+			rssi[deviceLocalName] = a.RSSI()
 		} else {
 			return
 		}
 	}, nil))
 
 	if len(foundDevices) == 0 {
-		fmt.Printf("No devices found, exiting...\n")
+		fmt.Printf("No devices found this cycle\n")
 		return
-	} else {
-		fmt.Printf("%d devices found:\n", len(foundDevices))
-		for id, info := range foundDevices {
-			fmt.Printf("ID: %s, %s\n", id, info.sensorName)
-		}
 	}
 
-	numConnections := len(foundDevices)
-	fmt.Printf("starting loop for %d devices\n", numConnections)
+	fmt.Printf("%d devices found:\n", len(foundDevices))
+	for id, info := range foundDevices {
+		fmt.Printf("ID: %s, %s\n", id, info.sensorName)
+	}
 
-	// topic -> payload
-	payloads := make(map[string]interface{})
+	published := 0
 	for deviceName, info := range foundDevices {
-		payload, err := getDeviceData(deviceName, info)
-		if err == nil {
-			fmt.Printf("got: %v\n", payload)
-			topic := knownSensors[deviceName].mqttTopic
-			payloads[topic] = payload
-		} else {
+		health.recordSeen(deviceName, info.sensorName, rssi[deviceName])
+
+		payload, err := getDeviceDataWithRetry(cycleCtx, deviceName, info, *readRetries)
+		health.recordResult(deviceName, info.sensorName, err)
+		if err != nil {
+			readFailuresTotal.Inc()
 			fmt.Printf("Error polling device %s: %s\n", deviceName, err)
+			continue
+		}
+
+		fmt.Printf("got: %v\n", payload)
+		recordReading(info, deviceName, rssi[deviceName], payload)
+
+		publisher, err := registry.For(info)
+		if err != nil {
+			publishFailuresTotal.Inc()
+			fmt.Printf("Error publishing for %s: %s\n", deviceName, err)
+			continue
 		}
+		if err := publisher.Publish(client, info.mqttTopic, info, payload); err != nil {
+			publishFailuresTotal.Inc()
+			fmt.Printf("Error publishing for %s: %s\n", deviceName, err)
+			continue
+		}
+		published++
+	}
+
+	fmt.Printf("published %d readings\n", published)
+	fmt.Println("cycle finished.")
+}
+
+// newMqttClient builds an MQTT client configured to survive network blips
+// across daemon iterations: it reconnects automatically and keeps the link
+// alive between cycles instead of requiring a fresh connection each time.
+// It also registers a retained Last Will & Testament, so the broker marks
+// the relay offline if it disappears without a clean disconnect, and
+// publishes a matching "online" birth message on every (re)connect.
+func newMqttClient(cfg mqttConfig) (mqtt.Client, error) {
+	var messagePubHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+		fmt.Printf("[MQTT] Received message: %s from topic: %s\n", msg.Payload(), msg.Topic())
+	}
+
+	var connectHandler mqtt.OnConnectHandler = func(client mqtt.Client) {
+		fmt.Println("[MQTT] Connected")
+		token := client.Publish(cfg.statusTopic, 0, true, "online")
+		token.Wait()
 	}
 
-	fmt.Printf("got %d payloads\n", len(payloads))
+	var connectLostHandler mqtt.ConnectionLostHandler = func(client mqtt.Client, err error) {
+		fmt.Printf("[MQTT] Connect lost: %v\n", err)
+	}
+
+	var reconnectHandler mqtt.ReconnectHandler = func(client mqtt.Client, opts *mqtt.ClientOptions) {
+		fmt.Println("[MQTT] Reconnecting...")
+	}
 
-	if len(payloads) > 0 {
-		var messagePubHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
-			fmt.Printf("[MQTT] Received message: %s from topic: %s\n", msg.Payload(), msg.Topic())
+	scheme := "tcp"
+	if cfg.tlsEnabled {
+		scheme = "tls"
+	}
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(fmt.Sprintf("%s://%s:%d", scheme, cfg.host, cfg.port))
+	opts.SetClientID(cfg.clientID)
+	opts.SetUsername(cfg.username)
+	opts.SetPassword(cfg.password)
+	opts.SetDefaultPublishHandler(messagePubHandler)
+	opts.OnConnect = connectHandler
+	opts.OnConnectionLost = connectLostHandler
+	opts.OnReconnecting = reconnectHandler
+	opts.SetAutoReconnect(true)
+	opts.SetKeepAlive(cfg.keepAlive)
+	opts.SetWill(cfg.statusTopic, "offline", 0, true)
+
+	if cfg.tlsEnabled {
+		tlsConfig, err := cfg.buildTLSConfig()
+		if err != nil {
+			return nil, errors.Wrap(err, "build MQTT TLS config")
 		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	fmt.Printf("[MQTT] connecting to host: %s\n", cfg.host)
+
+	return mqtt.NewClient(opts), nil
+}
 
-		var connectHandler mqtt.OnConnectHandler = func(client mqtt.Client) {
-			fmt.Println("[MQTT] Connected")
+// runPassiveCycle decodes readings straight out of the BLE advertisements
+// emitted by ATC_MiThermometer's custom firmware and publishes them as they
+// arrive, without ever calling ble.Connect. This is much faster and lighter
+// on the sensors' batteries than the GATT path in runCycle.
+func runPassiveCycle(cycleCtx context.Context, knownSensors map[string]sensorInfo, client mqtt.Client, registry *publisherRegistry, health *healthTracker) {
+	scanTotal.Inc()
+
+	scanContext := ble.WithSigHandler(context.WithTimeout(cycleCtx, *scanDuration))
+
+	fmt.Printf("Scanning passively for %s...\n", *scanDuration)
+	chkErr(ble.Scan(scanContext, true, func(a ble.Advertisement) {
+		serviceData := atcServiceData(a)
+		if serviceData == nil {
+			return
 		}
 
-		var connectLostHandler mqtt.ConnectionLostHandler = func(client mqtt.Client, err error) {
-			fmt.Printf("[MQTT] Connect lost: %v", err)
+		mac, payload, ok := parseAtcServiceData(serviceData)
+		if !ok {
+			return
 		}
 
-		opts := mqtt.NewClientOptions()
-		opts.AddBroker(fmt.Sprintf("tcp://%s:%d", *mqttHost, *mqttPort))
-		opts.SetClientID(*mqttClientId)
-		opts.SetDefaultPublishHandler(messagePubHandler)
-		opts.OnConnect = connectHandler
-		opts.OnConnectionLost = connectLostHandler
-		fmt.Printf("[MQTT] connecting to host: %s\n", *mqttHost)
-		client := mqtt.NewClient(opts)
-		if token := client.Connect(); token.Wait() && token.Error() != nil {
-			panic(token.Error())
+		// a device may be configured by MAC or by its ATC_xxxxxx local name;
+		// whichever key matched is what knownSensors and healthTracker both
+		// index by, so health has to be recorded under that same key rather
+		// than always the decoded mac, or publish keys off the section's
+		// local name never get a health entry knownSensors can look back up.
+		key := mac
+		info, known := knownSensors[key]
+		if !known {
+			key = a.LocalName()
+			info, known = knownSensors[key]
+		}
+		if !known {
+			return
 		}
 
-		for topic, payload := range payloads {
-			jsonPayload, err := json.Marshal(payload)
-			if err != nil {
-				log.Fatalf("[MQTT] can't marshal payload: %s", err)
-			}
+		payload["address"] = mac
+		payload["sensorname"] = info.sensorName
+		payload["timestamp"] = time.Now().UnixMilli() / 1000
 
-			fmt.Printf("[MQTT] Sending payload: %s\n", jsonPayload)
+		health.recordSeen(key, info.sensorName, a.RSSI())
+		recordReading(info, mac, a.RSSI(), payload)
 
-			// Publish the JSON payload to a topic
-			token := client.Publish(topic, 0, false, jsonPayload)
-			token.Wait()
+		publisher, err := registry.For(info)
+		if err == nil {
+			err = publisher.Publish(client, info.mqttTopic, info, payload)
+		}
+		health.recordResult(key, info.sensorName, err)
+		if err != nil {
+			publishFailuresTotal.Inc()
+			fmt.Printf("Error publishing for %s: %s\n", mac, err)
 		}
+	}, nil))
+}
 
-		client.Disconnect(1000)
+// atcServiceData returns the advertisement's service data for the
+// environmental sensing UUID (0x181A), which ATC1441 and pvvx custom
+// firmwares both reuse to carry their own packed sensor readings.
+func atcServiceData(a ble.Advertisement) []byte {
+	for _, sd := range a.ServiceData() {
+		if strings.EqualFold(sd.UUID.String(), environmentUUID) {
+			return sd.Data
+		}
+	}
+	return nil
+}
+
+// parseAtcServiceData decodes a temperature/humidity/battery reading from
+// 0x181A service data, auto-detecting the ATC1441 (13-byte, big-endian) or
+// pvvx "custom" (15-byte, little-endian) format from its length.
+func parseAtcServiceData(data []byte) (mac string, payload map[string]interface{}, ok bool) {
+	switch len(data) {
+	case 13: // ATC1441: mac(6) temp_i16be humidity_u8 battery_pct_u8 battery_mv_u16be frame_u8
+		temperature := float32(int16(binary.BigEndian.Uint16(data[6:8]))) / 10
+		return formatMac(data[0:6]), map[string]interface{}{
+			"temperature": temperature,
+			"humidity":    data[8],
+			"battery":     data[9],
+			"battery_mv":  binary.BigEndian.Uint16(data[10:12]),
+		}, true
+
+	case 15: // pvvx custom: mac(6, lo->hi) temp_i16le humidity_u16le battery_mv_u16le battery_pct_u8 counter_u8 flags_u8
+		temperature := float32(int16(binary.LittleEndian.Uint16(data[6:8]))) / 100
+		humidity := float32(binary.LittleEndian.Uint16(data[8:10])) / 100
+		// unlike ATC1441, pvvx's custom format stores the MAC lo->hi digit,
+		// i.e. byte-reversed relative to its usual hi->lo display order.
+		return formatMac(reverseMacBytes(data[0:6])), map[string]interface{}{
+			"temperature": temperature,
+			"humidity":    humidity,
+			"battery":     data[12],
+			"battery_mv":  binary.LittleEndian.Uint16(data[10:12]),
+		}, true
+
+	default:
+		return "", nil, false
+	}
+}
+
+// reverseMacBytes returns a copy of a 6-byte MAC with its byte order
+// reversed.
+func reverseMacBytes(b []byte) []byte {
+	reversed := make([]byte, len(b))
+	for i, v := range b {
+		reversed[len(b)-1-i] = v
+	}
+	return reversed
+}
+
+// formatMac renders a 6-byte address as the lowercase colon-separated form
+// used throughout devices.ini and ble.Addr.String().
+func formatMac(b []byte) string {
+	return strings.ToLower(fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", b[0], b[1], b[2], b[3], b[4], b[5]))
+}
+
+// getDeviceDataWithRetry calls getDeviceData, retrying up to retries times
+// with exponential backoff on failure. One flaky peripheral is never allowed
+// to kill the process; the caller gets the last error instead.
+func getDeviceDataWithRetry(ctx context.Context, nameOrAddress string, info sensorInfo, retries int) (map[string]interface{}, error) {
+	backoff := 500 * time.Millisecond
+
+	var lastErr error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			fmt.Printf("retrying %s in %s (attempt %d/%d)\n", nameOrAddress, backoff, attempt+1, retries+1)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		payload, err := getDeviceData(ctx, nameOrAddress, info)
+		if err == nil {
+			return payload, nil
+		}
+		lastErr = err
 	}
 
-	fmt.Println("All connections have finished.")
+	return nil, lastErr
 }
 
-func getDeviceData(nameOrAddress string, info sensorInfo) (map[string]interface{}, error) {
+func getDeviceData(ctx context.Context, nameOrAddress string, info sensorInfo) (map[string]interface{}, error) {
 	fmt.Printf("Connecting to %s...\n", nameOrAddress)
 	filter := func(a ble.Advertisement) bool {
 		return a.LocalName() == nameOrAddress || a.Addr().String() == nameOrAddress
 	}
-	serviceDiscoveryContext := ble.WithSigHandler(context.WithTimeout(context.Background(), 60*time.Second))
+	serviceDiscoveryContext := ble.WithSigHandler(context.WithTimeout(ctx, 60*time.Second))
 	cln, err := ble.Connect(serviceDiscoveryContext, filter)
 	if err != nil {
-		log.Fatalf("failed to connect to %s: %s", nameOrAddress, err)
-		return nil, err
+		return nil, errors.Wrapf(err, "failed to connect to %s", nameOrAddress)
 	}
 
 	// Make sure we had the chance to print out the message.
@@ -250,7 +527,9 @@ func getDeviceData(nameOrAddress string, info sensorInfo) (map[string]interface{
 	fmt.Printf("Discovering profile for device %s...\n", cln.Addr())
 	p, err := cln.DiscoverProfile(true)
 	if err != nil {
-		log.Fatalf("can't discover profile: %s", err)
+		cln.CancelConnection()
+		<-done
+		return nil, errors.Wrapf(err, "can't discover profile for %s", nameOrAddress)
 	}
 
 	// Start the exploration.
@@ -328,6 +607,10 @@ func propString(p ble.Property) string {
 	return s
 }
 
+// chkErr reports a ble.Scan error. It used to fatal on anything unexpected,
+// which was fine when the process scanned once and exited; now that scanning
+// happens once per cycle inside the daemon's ticker loop, a transient
+// BLE/HCI hiccup must not take the whole relay down with it.
 func chkErr(err error) {
 	switch errors.Cause(err) {
 	case nil:
@@ -336,6 +619,6 @@ func chkErr(err error) {
 	case context.Canceled:
 		fmt.Printf("canceled\n")
 	default:
-		log.Fatalf(err.Error())
+		fmt.Printf("scan error: %s\n", err)
 	}
 }
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAtcServiceData(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        []byte
+		wantMac     string
+		wantOk      bool
+		temperature float32
+		humidity    interface{}
+		battery     interface{}
+	}{
+		{
+			name: "ATC1441",
+			// mac(hi->lo) A4:C1:38:0C:5B:45, temp 21.5C, humidity 55%, battery 100%, 3000mV, frame 5
+			data:        []byte{0xA4, 0xC1, 0x38, 0x0C, 0x5B, 0x45, 0x00, 0xD7, 0x37, 0x64, 0x0B, 0xB8, 0x05},
+			wantMac:     "a4:c1:38:0c:5b:45",
+			wantOk:      true,
+			temperature: 21.5,
+			humidity:    uint8(0x37),
+			battery:     uint8(0x64),
+		},
+		{
+			name: "pvvx custom",
+			// mac stored lo->hi, i.e. A4:C1:38:0C:5B:45 reversed; temp 21.5C, humidity 55.36%, 3000mV, battery 100%, counter 5, flags 0
+			data:        []byte{0x45, 0x5B, 0x0C, 0x38, 0xC1, 0xA4, 0x66, 0x08, 0xA0, 0x15, 0xB8, 0x0B, 0x64, 0x05, 0x00},
+			wantMac:     "a4:c1:38:0c:5b:45",
+			wantOk:      true,
+			temperature: 21.5,
+			humidity:    float32(55.36),
+			battery:     uint8(0x64),
+		},
+		{
+			name:   "unrecognized length",
+			data:   []byte{0x01, 0x02, 0x03},
+			wantOk: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mac, payload, ok := parseAtcServiceData(tt.data)
+			if ok != tt.wantOk {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOk)
+			}
+			if !ok {
+				return
+			}
+
+			if mac != tt.wantMac {
+				t.Errorf("mac = %q, want %q", mac, tt.wantMac)
+			}
+			if payload["temperature"] != tt.temperature {
+				t.Errorf("temperature = %v, want %v", payload["temperature"], tt.temperature)
+			}
+			if !reflect.DeepEqual(payload["humidity"], tt.humidity) {
+				t.Errorf("humidity = %v, want %v", payload["humidity"], tt.humidity)
+			}
+			if !reflect.DeepEqual(payload["battery"], tt.battery) {
+				t.Errorf("battery = %v, want %v", payload["battery"], tt.battery)
+			}
+		})
+	}
+}
+
+func TestFormatMac(t *testing.T) {
+	got := formatMac([]byte{0xA4, 0xC1, 0x38, 0x0C, 0x5B, 0x45})
+	want := "a4:c1:38:0c:5b:45"
+	if got != want {
+		t.Errorf("formatMac() = %q, want %q", got, want)
+	}
+}
+
+func TestReverseMacBytes(t *testing.T) {
+	got := reverseMacBytes([]byte{0x45, 0x5B, 0x0C, 0x38, 0xC1, 0xA4})
+	want := []byte{0xA4, 0xC1, 0x38, 0x0C, 0x5B, 0x45}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("reverseMacBytes() = %x, want %x", got, want)
+	}
+}